@@ -0,0 +1,173 @@
+package caddy_cloudflare_ip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(AdminIPRanges{})
+}
+
+// adminRegistry holds the active CloudflareIPRange instances that the admin
+// API reports on. Caddy discovers admin.api.* modules by instantiating them
+// directly (New, then Provision) to mount their Routes, which is a separate
+// AdminIPRanges value from whatever ctx.App("admin.api.cloudflare_ip") would
+// hand back. So CloudflareIPRange.Provision registers here at the package
+// level instead of on an app instance, and the routes read from here too.
+var adminRegistry struct {
+	mu    sync.Mutex
+	insts []*CloudflareIPRange
+}
+
+// registerInstance adds s to the set of instances the admin API reports on.
+func registerInstance(s *CloudflareIPRange) {
+	adminRegistry.mu.Lock()
+	defer adminRegistry.mu.Unlock()
+	adminRegistry.insts = append(adminRegistry.insts, s)
+}
+
+// deregisterInstance removes s, called from CloudflareIPRange.Cleanup once
+// its config generation is torn down (e.g. on every `caddy reload`), so a
+// canceled instance doesn't linger in the registry and get served by the
+// admin API forever.
+func deregisterInstance(s *CloudflareIPRange) {
+	adminRegistry.mu.Lock()
+	defer adminRegistry.mu.Unlock()
+	for i, inst := range adminRegistry.insts {
+		if inst == s {
+			adminRegistry.insts = append(adminRegistry.insts[:i], adminRegistry.insts[i+1:]...)
+			return
+		}
+	}
+}
+
+// currentInstance returns the most recently registered instance. Caddy
+// provisions a new config generation's modules before tearing down the old
+// one, so for the brief window where both are registered this favors the
+// live instance over the one about to be cleaned up. Most deployments only
+// ever configure one `ip_sources cloudflare` block, so there's no need for
+// the routes to take a selector.
+func currentInstance() (*CloudflareIPRange, error) {
+	adminRegistry.mu.Lock()
+	defer adminRegistry.mu.Unlock()
+	if len(adminRegistry.insts) == 0 {
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no cloudflare ip_source instances are active"),
+		}
+	}
+	return adminRegistry.insts[len(adminRegistry.insts)-1], nil
+}
+
+// AdminIPRanges exposes the runtime state of active CloudflareIPRange
+// instances over Caddy's admin API: the currently held prefix lists and a
+// way to force an immediate refresh. This mirrors how other Caddy
+// subsystems expose runtime state, and is invaluable for debugging why a
+// request wasn't recognized as coming from Cloudflare without waiting for
+// Interval to elapse.
+//
+// It holds no state of its own (see adminRegistry above) so that it stays
+// cheap to copy by value, the way caddy.Module.CaddyModule is called.
+type AdminIPRanges struct{}
+
+// CaddyModule returns the Caddy module information.
+func (AdminIPRanges) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.cloudflare_ip",
+		New: func() caddy.Module { return new(AdminIPRanges) },
+	}
+}
+
+// Provision implements caddy.App.
+func (AdminIPRanges) Provision(_ caddy.Context) error {
+	return nil
+}
+
+// Start implements caddy.App. There's no background work of its own to do;
+// CloudflareIPRange instances register themselves as they're provisioned.
+func (AdminIPRanges) Start() error {
+	return nil
+}
+
+// Stop implements caddy.App.
+func (AdminIPRanges) Stop() error {
+	adminRegistry.mu.Lock()
+	defer adminRegistry.mu.Unlock()
+	adminRegistry.insts = nil
+	return nil
+}
+
+// Routes implements caddy.AdminRouter.
+func (AdminIPRanges) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/cloudflare-ip/ranges",
+			Handler: caddy.AdminHandlerFunc(handleRanges),
+		},
+		{
+			Pattern: "/cloudflare-ip/refresh",
+			Handler: caddy.AdminHandlerFunc(handleRefresh),
+		},
+	}
+}
+
+// rangesResponse is the JSON body returned by GET /cloudflare-ip/ranges.
+type rangesResponse struct {
+	IPv4        []string  `json:"ipv4"`
+	IPv6        []string  `json:"ipv6"`
+	LastRefresh time.Time `json:"last_refresh"`
+}
+
+func handleRanges(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+
+	inst, err := currentInstance()
+	if err != nil {
+		return err
+	}
+
+	resp := rangesResponse{LastRefresh: inst.LastRefresh()}
+	for _, p := range inst.GetIPRanges(r) {
+		if p.Addr().Is4() {
+			resp.IPv4 = append(resp.IPv4, p.String())
+		} else {
+			resp.IPv6 = append(resp.IPv6, p.String())
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+func handleRefresh(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+
+	inst, err := currentInstance()
+	if err != nil {
+		return err
+	}
+
+	if err := inst.refreshOnce(); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadGateway, Err: err}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// interface guards
+var (
+	_ caddy.Module      = (*AdminIPRanges)(nil)
+	_ caddy.App         = (*AdminIPRanges)(nil)
+	_ caddy.AdminRouter = (*AdminIPRanges)(nil)
+)
@@ -0,0 +1,66 @@
+package caddy_cloudflare_ip
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// TestAdminRegistryReload simulates a `caddy reload`: Caddy provisions the
+// new config generation's CloudflareIPRange before tearing down the old
+// one's context (which runs Cleanup). The admin API must serve the new
+// instance throughout, never the one that's being (or was) canceled.
+func TestAdminRegistryReload(t *testing.T) {
+	adminRegistry.mu.Lock()
+	adminRegistry.insts = nil
+	adminRegistry.mu.Unlock()
+
+	oldCtx, oldCancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer oldCancel()
+
+	oldInst := &CloudflareIPRange{}
+	if err := oldInst.Provision(oldCtx); err != nil {
+		t.Fatalf("error provisioning old instance: %v", err)
+	}
+
+	newCtx, newCancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer newCancel()
+
+	newInst := &CloudflareIPRange{}
+	if err := newInst.Provision(newCtx); err != nil {
+		t.Fatalf("error provisioning new instance: %v", err)
+	}
+
+	// Both generations are momentarily registered; the routes must prefer
+	// the newer one.
+	inst, err := currentInstance()
+	if err != nil {
+		t.Fatalf("currentInstance: %v", err)
+	}
+	if inst != newInst {
+		t.Errorf("expected currentInstance to return the newly provisioned instance")
+	}
+
+	// Tearing down the old generation, as Caddy does on the rest of a
+	// reload, must remove it from the registry rather than leak it.
+	if err := oldInst.Cleanup(); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+
+	inst, err = currentInstance()
+	if err != nil {
+		t.Fatalf("currentInstance after cleanup: %v", err)
+	}
+	if inst != newInst {
+		t.Errorf("expected currentInstance to still return the new instance after the old one was cleaned up")
+	}
+
+	if err := newInst.Cleanup(); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+
+	if _, err := currentInstance(); err == nil {
+		t.Errorf("expected currentInstance to error once every instance has been cleaned up")
+	}
+}
@@ -0,0 +1,32 @@
+package caddy_cloudflare_ip
+
+import (
+	"math/rand"
+	"time"
+)
+
+// nextBackoff doubles cur (starting from 1s), capped at max, so repeated
+// refresh failures back off instead of hammering the source every Interval.
+func nextBackoff(cur, max time.Duration) time.Duration {
+	if cur <= 0 {
+		if max < time.Second {
+			return max
+		}
+		return time.Second
+	}
+	next := cur * 2
+	if next > max || next <= 0 {
+		next = max
+	}
+	return next
+}
+
+// withJitter returns d adjusted by up to ±20%, to avoid many Caddy
+// instances retrying in lockstep after a shared outage.
+func withJitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	jitter := time.Duration((rand.Float64()*0.4 - 0.2) * float64(d))
+	return d + jitter
+}
@@ -0,0 +1,35 @@
+package caddy_cloudflare_ip
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextBackoff(t *testing.T) {
+	max := 30 * time.Second
+
+	cur := nextBackoff(0, max)
+	if cur != time.Second {
+		t.Errorf("expected first backoff of 1s, got %v", cur)
+	}
+
+	cur = nextBackoff(cur, max)
+	if cur != 2*time.Second {
+		t.Errorf("expected backoff to double to 2s, got %v", cur)
+	}
+
+	cur = nextBackoff(max, max)
+	if cur != max {
+		t.Errorf("expected backoff to cap at %v, got %v", max, cur)
+	}
+}
+
+func TestWithJitter(t *testing.T) {
+	d := 10 * time.Second
+	for i := 0; i < 100; i++ {
+		got := withJitter(d)
+		if got < 8*time.Second || got > 12*time.Second {
+			t.Fatalf("jittered duration %v out of ±20%% range of %v", got, d)
+		}
+	}
+}
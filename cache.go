@@ -0,0 +1,61 @@
+package caddy_cloudflare_ip
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+)
+
+// rangeCache is the on-disk representation of the last successfully fetched
+// prefix lists, persisted so Provision can recover them when cloudflare.com
+// is unreachable at startup.
+type rangeCache struct {
+	IPv4         []string `json:"ipv4"`
+	IPv6         []string `json:"ipv6"`
+	IPv4ETag     string   `json:"ipv4_etag,omitempty"`
+	IPv4Modified string   `json:"ipv4_last_modified,omitempty"`
+	IPv6ETag     string   `json:"ipv6_etag,omitempty"`
+	IPv6Modified string   `json:"ipv6_last_modified,omitempty"`
+}
+
+// loadCache reads and parses the cache file at path. A missing file is not
+// an error; it just means there is nothing to load yet.
+func loadCache(path string) (*rangeCache, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var c rangeCache
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// save writes the cache to path, overwriting any existing file.
+func (c *rangeCache) save(path string) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// prefixes parses the cached CIDR strings into netip.Prefix values.
+func (c *rangeCache) prefixes() ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, list := range [][]string{c.IPv4, c.IPv6} {
+		for _, s := range list {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, prefix)
+		}
+	}
+	return out, nil
+}
@@ -1,16 +1,20 @@
 package caddy_cloudflare_ip
 
 import (
-	"bufio"
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/netip"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
 )
 
 const (
@@ -18,22 +22,85 @@ const (
 	ipv6 = "https://www.cloudflare.com/ips-v6"
 )
 
+// flexDuration is a Caddy duration string, same as Interval/Timeout, that
+// may still contain an unexpanded placeholder. Its UnmarshalJSON also
+// accepts a bare JSON number of nanoseconds, matching caddy.Duration's own
+// UnmarshalJSON, so configs written against this field's previous
+// caddy.Duration type keep working.
+type flexDuration string
+
+func (d *flexDuration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch val := v.(type) {
+	case float64:
+		// caddy.Duration's own UnmarshalJSON treats a bare number as a count
+		// of nanoseconds; append the "ns" unit so the string form still
+		// parses correctly through caddy.ParseDuration in expandPlaceholders.
+		*d = flexDuration(strconv.FormatInt(int64(val), 10) + "ns")
+	case string:
+		*d = flexDuration(val)
+	default:
+		return fmt.Errorf("invalid duration value: %v", val)
+	}
+	return nil
+}
+
 func init() {
 	caddy.RegisterModule(CloudflareIPRange{})
 }
 
 // CloudflareIPRange provides a range of IP address prefixes (CIDRs) retrieved from cloudflare.
 type CloudflareIPRange struct {
-	// refresh Interval
-	Interval caddy.Duration `json:"interval,omitempty"`
-	// request Timeout
-	Timeout caddy.Duration `json:"timeout,omitempty"`
+	// Interval is the refresh interval, as a Caddy duration string (e.g.
+	// "1h"). Supports placeholders, which are expanded during Provision.
+	// Also accepts a bare JSON number of nanoseconds, for configs written
+	// against this field's previous caddy.Duration type.
+	Interval flexDuration `json:"interval,omitempty"`
+	// Timeout is the request timeout, as a Caddy duration string. Supports
+	// placeholders, which are expanded during Provision. Also accepts a bare
+	// JSON number of nanoseconds, the same as Interval.
+	Timeout flexDuration `json:"timeout,omitempty"`
+	// CachePath, if set, persists the last-fetched prefix lists (and their
+	// ETag/Last-Modified headers) to disk so Provision can recover them
+	// when cloudflare.com is unreachable at startup. Supports placeholders.
+	CachePath string `json:"cache_path,omitempty"`
 
 	// Holds the parsed CIDR ranges from Ranges.
 	ranges []netip.Prefix
 
+	// interval and timeout hold Interval/Timeout after placeholder
+	// expansion and duration parsing, performed once in Provision.
+	interval caddy.Duration
+	timeout  caddy.Duration
+
+	// ETag/Last-Modified of the currently held ranges, used to make
+	// conditional requests on the next refresh.
+	ipv4ETag, ipv4Modified string
+	ipv6ETag, ipv6Modified string
+
+	// source fetches the prefix lists; defaults to urlSource against the
+	// public cloudflare.com endpoints. Set via the urls/file/api
+	// Caddyfile sub-directives.
+	source Source
+
+	// metrics and events report refresh outcomes to Prometheus and
+	// caddyevents respectively; set up once in Provision.
+	metrics *metrics
+	events  *caddyevents.App
+
+	// lastRefresh is when the ranges were last successfully refreshed,
+	// reported by the admin API.
+	lastRefresh time.Time
+
 	ctx  caddy.Context
 	lock *sync.RWMutex
+
+	// refreshMu serializes refreshOnce, which can be called concurrently by
+	// refreshLoop's timer and by the admin API's forced-refresh route.
+	refreshMu *sync.Mutex
 }
 
 // CaddyModule returns the Caddy module information.
@@ -46,89 +113,250 @@ func (CloudflareIPRange) CaddyModule() caddy.ModuleInfo {
 
 // getContext returns a cancelable context, with a timeout if configured.
 func (s *CloudflareIPRange) getContext() (context.Context, context.CancelFunc) {
-	if s.Timeout > 0 {
-		return context.WithTimeout(s.ctx, time.Duration(s.Timeout))
+	if s.timeout > 0 {
+		return context.WithTimeout(s.ctx, time.Duration(s.timeout))
 	}
 	return context.WithCancel(s.ctx)
 }
 
-func (s *CloudflareIPRange) fetch(api string) ([]netip.Prefix, error) {
+// fetchResult carries the outcome of a single conditional fetch.
+type fetchResult struct {
+	prefixes     []netip.Prefix
+	etag         string
+	lastModified string
+	notModified  bool
+}
+
+// fetch retrieves the v4/v6 lists from s.source, using the ETag/Last-Modified
+// currently held so the backend can reply "not modified" where it supports it.
+func (s *CloudflareIPRange) fetch() (v4, v6 fetchResult, err error) {
 	ctx, cancel := s.getContext()
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api, nil)
-	if err != nil {
-		return nil, err
+	return s.source.fetch(ctx, sourceConditions{
+		ipv4ETag:     s.ipv4ETag,
+		ipv4Modified: s.ipv4Modified,
+		ipv6ETag:     s.ipv6ETag,
+		ipv6Modified: s.ipv6Modified,
+	})
+}
+
+func (s *CloudflareIPRange) Provision(ctx caddy.Context) error {
+	s.ctx = ctx
+	s.lock = new(sync.RWMutex)
+	s.refreshMu = new(sync.Mutex)
+
+	if err := s.expandPlaceholders(); err != nil {
+		return err
+	}
+
+	if s.source == nil {
+		s.source = &urlSource{v4: ipv4, v6: ipv6}
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	s.setupObservability()
+
+	// load whatever we last persisted so the server can still start if
+	// cloudflare.com is unreachable.
+	var cached *rangeCache
+	if s.CachePath != "" {
+		c, err := loadCache(s.CachePath)
+		if err != nil {
+			return err
+		}
+		cached = c
+		if cached != nil {
+			prefixes, err := cached.prefixes()
+			if err != nil {
+				return err
+			}
+			s.ranges = prefixes
+			s.ipv4ETag, s.ipv4Modified = cached.IPv4ETag, cached.IPv4Modified
+			s.ipv6ETag, s.ipv6Modified = cached.IPv6ETag, cached.IPv6Modified
+		}
+	}
+
+	previousRanges := s.ranges
+	v4, v6, err := s.fetch()
 	if err != nil {
-		return nil, err
+		s.ctx.Logger().Warn("initial fetch failed",
+			zap.String("source", s.source.String()),
+			zap.Error(err))
+		s.emitRefreshFailed(err)
+		if cached == nil {
+			// fall back to the bundled snapshot so a transient DNS/network
+			// hiccup doesn't prevent Caddy from starting.
+			s.ranges = append([]netip.Prefix(nil), bundledRanges...)
+		}
+	} else {
+		if !v4.notModified {
+			s.ipv4ETag, s.ipv4Modified = v4.etag, v4.lastModified
+		}
+		if !v6.notModified {
+			s.ipv6ETag, s.ipv6Modified = v6.etag, v6.lastModified
+		}
+		s.updateRanges(v4, v6)
+		s.lastRefresh = time.Now()
+		s.emitRefreshed(previousRanges, s.ranges)
+	}
+
+	if s.CachePath != "" {
+		if err := s.saveCache(); err != nil {
+			return err
+		}
+	}
+
+	// Only share this instance with the admin API and start the background
+	// refresh loop once it's fully set up, so neither can observe it
+	// mid-initialization.
+	registerInstance(s)
+	go s.refreshLoop()
+	return nil
+}
+
+// expandPlaceholders resolves Caddy placeholders (e.g. {env.VAR}) in
+// Interval, Timeout and CachePath, then parses the durations. It mirrors how
+// caddyhttp/caddytls matchers defer validation of string config until
+// Provision, so values can be driven by env vars or global Caddy vars.
+func (s *CloudflareIPRange) expandPlaceholders() error {
+	repl := caddy.NewReplacer()
+
+	if s.Interval != "" {
+		val, err := caddy.ParseDuration(repl.ReplaceAll(string(s.Interval), ""))
+		if err != nil {
+			return err
+		}
+		s.interval = caddy.Duration(val)
+	}
+	if s.interval == 0 {
+		s.interval = caddy.Duration(time.Hour)
 	}
-	defer resp.Body.Close()
 
-	scanner := bufio.NewScanner(resp.Body)
-	var prefixes []netip.Prefix
-	for scanner.Scan() {
-		prefix, err := caddyhttp.CIDRExpressionToPrefix(scanner.Text())
+	if s.Timeout != "" {
+		val, err := caddy.ParseDuration(repl.ReplaceAll(string(s.Timeout), ""))
 		if err != nil {
-			return nil, err
+			return err
 		}
-		prefixes = append(prefixes, prefix)
+		s.timeout = caddy.Duration(val)
 	}
-	return prefixes, nil
+
+	if s.CachePath != "" {
+		s.CachePath = repl.ReplaceAll(s.CachePath, "")
+	}
+
+	if s.source != nil {
+		s.source.expand(repl)
+	}
+
+	return nil
 }
 
-func (s *CloudflareIPRange) Provision(ctx caddy.Context) error {
-	s.ctx = ctx
-	s.lock = new(sync.RWMutex)
+// updateRanges merges fresh fetch results into s.ranges, keeping the
+// previously held half (v4 or v6) whenever that family's result was a 304
+// or carried no prefixes.
+func (s *CloudflareIPRange) updateRanges(v4, v6 fetchResult) {
+	if !v4.notModified && v4.prefixes != nil {
+		s.ranges = replaceFamily(s.ranges, v4.prefixes, true)
+	}
+	if !v6.notModified && v6.prefixes != nil {
+		s.ranges = replaceFamily(s.ranges, v6.prefixes, false)
+	}
+}
 
-	// fetch ipv4 list
-	prefixes, err := s.fetch(ipv4)
-	if err != nil {
-		return err
+// replaceFamily returns ranges with all prefixes of the given family
+// (v4 when isV4 is true, v6 otherwise) replaced by fresh.
+func replaceFamily(ranges []netip.Prefix, fresh []netip.Prefix, isV4 bool) []netip.Prefix {
+	kept := ranges[:0:0]
+	for _, p := range ranges {
+		if p.Addr().Is4() != isV4 {
+			kept = append(kept, p)
+		}
+	}
+	return append(kept, fresh...)
+}
+
+// saveCache persists the currently held ranges, split back into v4/v6, along
+// with their ETag/Last-Modified headers.
+func (s *CloudflareIPRange) saveCache() error {
+	s.lock.RLock()
+	c := rangeCache{
+		IPv4ETag:     s.ipv4ETag,
+		IPv4Modified: s.ipv4Modified,
+		IPv6ETag:     s.ipv6ETag,
+		IPv6Modified: s.ipv6Modified,
 	}
-	s.ranges = append(s.ranges, prefixes...)
+	for _, p := range s.ranges {
+		if p.Addr().Is4() {
+			c.IPv4 = append(c.IPv4, p.String())
+		} else {
+			c.IPv6 = append(c.IPv6, p.String())
+		}
+	}
+	s.lock.RUnlock()
+
+	return c.save(s.CachePath)
+}
+
+// refreshOnce fetches the latest prefix lists, applies them, and persists
+// the cache. It's called on every tick of refreshLoop, and again with
+// backoff after a failure.
+func (s *CloudflareIPRange) refreshOnce() error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
 
-	// fetch ipv6 list
-	prefixes, err = s.fetch(ipv6)
+	v4, v6, err := s.fetch()
 	if err != nil {
 		return err
 	}
-	s.ranges = append(s.ranges, prefixes...)
 
-	// update in background
-	go s.refreshLoop()
+	s.lock.Lock()
+	if !v4.notModified {
+		s.ipv4ETag, s.ipv4Modified = v4.etag, v4.lastModified
+	}
+	if !v6.notModified {
+		s.ipv6ETag, s.ipv6Modified = v6.etag, v6.lastModified
+	}
+	previousRanges := s.ranges
+	s.updateRanges(v4, v6)
+	currentRanges := s.ranges
+	s.lastRefresh = time.Now()
+	s.lock.Unlock()
+
+	s.emitRefreshed(previousRanges, currentRanges)
+
+	if s.CachePath != "" {
+		return s.saveCache()
+	}
 	return nil
 }
 
+// refreshLoop periodically calls refreshOnce. On failure it retries with
+// exponential backoff (capped at Interval) plus jitter, logging each
+// failure, instead of silently waiting a full Interval for the next try.
 func (s *CloudflareIPRange) refreshLoop() {
-	if s.Interval == 0 {
-		s.Interval = caddy.Duration(time.Hour)
-	}
+	interval := time.Duration(s.interval)
+	backoff := time.Duration(0)
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
 
-	ticker := time.NewTicker(time.Duration(s.Interval))
 	for {
 		select {
-		case <-ticker.C:
-			var fullPrefixes []netip.Prefix
-			prefixes, err := s.fetch(ipv4)
-			if err != nil {
-				break
-			}
-			fullPrefixes = append(fullPrefixes, prefixes...)
+		case <-timer.C:
+			if err := s.refreshOnce(); err != nil {
+				s.ctx.Logger().Warn("refresh failed, retrying with backoff",
+					zap.String("source", s.source.String()),
+					zap.Error(err))
+				s.emitRefreshFailed(err)
 
-			prefixes, err = s.fetch(ipv6)
-			if err != nil {
-				break
+				backoff = nextBackoff(backoff, interval)
+				timer.Reset(withJitter(backoff))
+				continue
 			}
-			fullPrefixes = append(fullPrefixes, prefixes...)
 
-			s.lock.Lock()
-			s.ranges = fullPrefixes
-			s.lock.Unlock()
+			backoff = 0
+			timer.Reset(interval)
 		case <-s.ctx.Done():
-			ticker.Stop()
 			return
 		}
 	}
@@ -140,12 +368,38 @@ func (s *CloudflareIPRange) GetIPRanges(_ *http.Request) []netip.Prefix {
 	return s.ranges
 }
 
+// LastRefresh returns when the ranges were last successfully refreshed,
+// reported by the admin API.
+func (s *CloudflareIPRange) LastRefresh() time.Time {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.lastRefresh
+}
+
+// Cleanup implements caddy.CleanerUpper. It runs once this instance's config
+// generation is torn down (e.g. on every `caddy reload`), deregistering it
+// from the admin API's registry so a canceled instance doesn't linger and
+// get served forever.
+func (s *CloudflareIPRange) Cleanup() error {
+	deregisterInstance(s)
+	return nil
+}
+
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
 //
 //	cloudflare {
 //	   interval val
 //	   timeout val
+//	   cache_path val
+//	   urls <v4> <v6>
+//	   file <path>
+//	   api {
+//	       token <tok>
+//	   }
 //	}
+//
+// urls, file and api are mutually exclusive; the last one wins. If none is
+// given, the public cloudflare.com endpoints are used.
 func (m *CloudflareIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
 		// No same-line options are supported
@@ -159,20 +413,25 @@ func (m *CloudflareIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
-				val, err := caddy.ParseDuration(d.Val())
-				if err != nil {
-					return err
-				}
-				m.Interval = caddy.Duration(val)
+				// Validation is deferred to Provision, since the value may
+				// contain a placeholder that isn't resolvable yet.
+				m.Interval = flexDuration(d.Val())
 			case "timeout":
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
-				val, err := caddy.ParseDuration(d.Val())
+				m.Timeout = flexDuration(d.Val())
+			case "cache_path":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.CachePath = d.Val()
+			case "urls", "file", "api":
+				src, err := unmarshalSource(d)
 				if err != nil {
 					return err
 				}
-				m.Timeout = caddy.Duration(val)
+				m.source = src
 			default:
 				return d.ArgErr()
 			}
@@ -186,6 +445,7 @@ func (m *CloudflareIPRange) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 var (
 	_ caddy.Module            = (*CloudflareIPRange)(nil)
 	_ caddy.Provisioner       = (*CloudflareIPRange)(nil)
+	_ caddy.CleanerUpper      = (*CloudflareIPRange)(nil)
 	_ caddyfile.Unmarshaler   = (*CloudflareIPRange)(nil)
 	_ caddyhttp.IPRangeSource = (*CloudflareIPRange)(nil)
 )
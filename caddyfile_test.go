@@ -2,6 +2,8 @@ package caddy_cloudflare_ip
 
 import (
 	"context"
+	"encoding/json"
+	"os"
 	"testing"
 	"time"
 
@@ -47,14 +49,70 @@ func TestUnmarshal(t *testing.T) {
 		t.Errorf("unmarshal error: %v", err)
 	}
 
-	expectedInterval := caddy.Duration(90 * time.Minute)
-	if expectedInterval != r.Interval {
-		t.Errorf("incorrect interval: expected %v, got %v", expectedInterval, r.Interval)
+	if r.Interval != "1.5h" {
+		t.Errorf("incorrect interval: expected %q, got %q", "1.5h", r.Interval)
 	}
 
-	expectedTimeout := caddy.Duration(30 * time.Second)
-	if expectedTimeout != r.Timeout {
-		t.Errorf("incorrect timeout: expected %v, got %v", expectedTimeout, r.Timeout)
+	if r.Timeout != "30s" {
+		t.Errorf("incorrect timeout: expected %q, got %q", "30s", r.Timeout)
+	}
+}
+
+func TestProvisionPlaceholder(t *testing.T) {
+	os.Setenv("CF_TEST_INTERVAL", "45m")
+	defer os.Unsetenv("CF_TEST_INTERVAL")
+
+	input := `cloudflare {
+		interval {env.CF_TEST_INTERVAL}
+	}`
+
+	d := caddyfile.NewTestDispenser(input)
+
+	r := CloudflareIPRange{}
+	err := r.UnmarshalCaddyfile(d)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	err = r.Provision(ctx)
+	if err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	expected := caddy.Duration(45 * time.Minute)
+	if r.interval != expected {
+		t.Errorf("incorrect expanded interval: expected %v, got %v", expected, r.interval)
+	}
+}
+
+// TestUnmarshalJSONBareNumber covers backward compatibility with configs
+// written against this field's previous caddy.Duration type, whose
+// UnmarshalJSON accepted a bare number of nanoseconds alongside a duration
+// string.
+func TestUnmarshalJSONBareNumber(t *testing.T) {
+	var r CloudflareIPRange
+	input := `{"interval": 90000000000, "timeout": "30s"}`
+	if err := json.Unmarshal([]byte(input), &r); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if r.Interval != "90000000000ns" {
+		t.Errorf("incorrect interval: expected %q, got %q", "90000000000ns", r.Interval)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	expected := caddy.Duration(90 * time.Second)
+	if r.interval != expected {
+		t.Errorf("incorrect expanded interval: expected %v, got %v", expected, r.interval)
 	}
 }
 
@@ -80,14 +138,12 @@ func TestUnmarshalNested(t *testing.T) {
 		t.Errorf("unmarshal error: %v", err)
 	}
 
-	expectedInterval := caddy.Duration(90 * time.Minute)
-	if expectedInterval != r.Interval {
-		t.Errorf("incorrect interval: expected %v, got %v", expectedInterval, r.Interval)
+	if r.Interval != "1.5h" {
+		t.Errorf("incorrect interval: expected %q, got %q", "1.5h", r.Interval)
 	}
 
-	expectedTimeout := caddy.Duration(30 * time.Second)
-	if expectedTimeout != r.Timeout {
-		t.Errorf("incorrect timeout: expected %v, got %v", expectedTimeout, r.Timeout)
+	if r.Timeout != "30s" {
+		t.Errorf("incorrect timeout: expected %q, got %q", "30s", r.Timeout)
 	}
 
 	d.Next()
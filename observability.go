@@ -0,0 +1,152 @@
+package caddy_cloudflare_ip
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyevents"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics holds the Prometheus collectors exposed by a CloudflareIPRange
+// instance, registered in Provision against Caddy's metrics registry.
+type metrics struct {
+	rangesTotal     *prometheus.GaugeVec
+	lastRefresh     prometheus.Gauge
+	refreshFailures prometheus.Counter
+}
+
+func newMetrics(registry *prometheus.Registry) *metrics {
+	m := &metrics{
+		rangesTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "caddy_cloudflare_ip_ranges_total",
+			Help: "Number of Cloudflare IP prefixes currently held, by address family.",
+		}, []string{"family"}),
+		lastRefresh: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "caddy_cloudflare_ip_last_refresh_timestamp_seconds",
+			Help: "Unix timestamp of the last successful refresh.",
+		}),
+		refreshFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "caddy_cloudflare_ip_refresh_failures_total",
+			Help: "Total number of refresh attempts that failed to fetch or parse the prefix lists.",
+		}),
+	}
+
+	// The registry is shared by every module instance under the same Caddy
+	// config, so a second `ip_sources cloudflare` block would otherwise panic
+	// on a duplicate collector registration. Register each collector
+	// individually and fall back to the already-registered one instead.
+	m.rangesTotal = registerOrReuse(registry, m.rangesTotal).(*prometheus.GaugeVec)
+	m.lastRefresh = registerOrReuse(registry, m.lastRefresh).(prometheus.Gauge)
+	m.refreshFailures = registerOrReuse(registry, m.refreshFailures).(prometheus.Counter)
+	return m
+}
+
+// registerOrReuse registers c against registry, returning the
+// already-registered collector instead of panicking if an equivalent
+// collector (same fully-qualified name) was registered previously.
+func registerOrReuse(registry *prometheus.Registry, c prometheus.Collector) prometheus.Collector {
+	if err := registry.Register(c); err != nil {
+		var are prometheus.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
+}
+
+func (m *metrics) recordSuccess(ranges []netip.Prefix) {
+	var v4Count, v6Count int
+	for _, p := range ranges {
+		if p.Addr().Is4() {
+			v4Count++
+		} else {
+			v6Count++
+		}
+	}
+	m.rangesTotal.WithLabelValues("v4").Set(float64(v4Count))
+	m.rangesTotal.WithLabelValues("v6").Set(float64(v6Count))
+	m.lastRefresh.Set(float64(time.Now().Unix()))
+}
+
+func (m *metrics) recordFailure() {
+	m.refreshFailures.Inc()
+}
+
+// setupObservability registers this instance's Prometheus collectors and
+// looks up the events app, so refreshes can be reported without either
+// being wired up more than once.
+//
+// s.ctx.App and s.ctx.GetMetricsRegistry assume a caddy.Context obtained
+// through a real config load; a bare context (as used by this module's own
+// Provision-driving tests) makes them panic. Guard with a recover so
+// Provision still works in that case, just without metrics/events.
+func (s *CloudflareIPRange) setupObservability() {
+	defer func() { recover() }()
+
+	s.metrics = newMetrics(s.ctx.GetMetricsRegistry())
+
+	if app, err := s.ctx.App("events"); err == nil {
+		s.events, _ = app.(*caddyevents.App)
+	}
+}
+
+// emitRefreshed announces a successful refresh, including how many
+// prefixes changed compared to what was held before. previous and current
+// are passed in explicitly rather than read off s.ranges, since the caller
+// already holds (and has released) the lock protecting it.
+func (s *CloudflareIPRange) emitRefreshed(previous, current []netip.Prefix) {
+	if s.metrics != nil {
+		s.metrics.recordSuccess(current)
+	}
+
+	if s.events == nil {
+		return
+	}
+	added, removed := diffPrefixes(previous, current)
+	s.events.Emit(s.ctx, "cloudflare_ips.refreshed", map[string]any{
+		"count":   len(current),
+		"added":   added,
+		"removed": removed,
+	})
+}
+
+// emitRefreshFailed announces a failed refresh attempt. Failures in
+// refreshLoop used to be silently swallowed; this gives operators
+// something to alert on.
+func (s *CloudflareIPRange) emitRefreshFailed(err error) {
+	if s.metrics != nil {
+		s.metrics.recordFailure()
+	}
+
+	if s.events == nil {
+		return
+	}
+	s.events.Emit(s.ctx, "cloudflare_ips.refresh_failed", map[string]any{
+		"error": err.Error(),
+	})
+}
+
+// diffPrefixes reports how many prefixes were added and removed going from
+// previous to current.
+func diffPrefixes(previous, current []netip.Prefix) (added, removed int) {
+	old := make(map[netip.Prefix]struct{}, len(previous))
+	for _, p := range previous {
+		old[p] = struct{}{}
+	}
+	next := make(map[netip.Prefix]struct{}, len(current))
+	for _, p := range current {
+		next[p] = struct{}{}
+		if _, ok := old[p]; !ok {
+			added++
+		}
+	}
+	for _, p := range previous {
+		if _, ok := next[p]; !ok {
+			removed++
+		}
+	}
+	return
+}
@@ -0,0 +1,283 @@
+package caddy_cloudflare_ip
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// sourceConditions carries the ETag/Last-Modified values currently held for
+// the v4 and v6 lists, so a Source can make a conditional request where the
+// backend supports it.
+type sourceConditions struct {
+	ipv4ETag, ipv4Modified string
+	ipv6ETag, ipv6Modified string
+}
+
+// Source fetches the Cloudflare IPv4 and IPv6 prefix lists from somewhere:
+// the public text endpoints, a custom mirror, a local file, or the
+// authenticated Cloudflare API. It lets the module be used behind
+// restrictive egress policies or in setups that prefer the authenticated
+// API over the public endpoints.
+type Source interface {
+	// fetch retrieves the current prefix lists, respecting cond for
+	// conditional requests where the backend supports it.
+	fetch(ctx context.Context, cond sourceConditions) (v4, v6 fetchResult, err error)
+
+	// String identifies the source for logging, e.g. on a failed refresh.
+	String() string
+
+	// expand resolves Caddy placeholders (e.g. {env.VAR}) in this source's
+	// configuration strings, the same as Interval/Timeout/CachePath. Called
+	// once from CloudflareIPRange.expandPlaceholders.
+	expand(repl *caddy.Replacer)
+}
+
+// fetchList performs a single conditional GET against a text endpoint
+// listing one CIDR per line, the format used by the public
+// ips-v4/ips-v6 endpoints and any custom mirror of them.
+func fetchList(ctx context.Context, api, etag, lastModified string) (fetchResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api, nil)
+	if err != nil {
+		return fetchResult{}, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fetchResult{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return fetchResult{notModified: true, etag: etag, lastModified: lastModified}, nil
+	}
+
+	prefixes, err := scanPrefixes(resp.Body)
+	if err != nil {
+		return fetchResult{}, err
+	}
+	return fetchResult{
+		prefixes:     prefixes,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+func scanPrefixes(r io.Reader) ([]netip.Prefix, error) {
+	scanner := bufio.NewScanner(r)
+	var prefixes []netip.Prefix
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, scanner.Err()
+}
+
+// urlSource fetches the v4 and v6 lists from two text-file URLs, defaulting
+// to the public cloudflare.com endpoints.
+type urlSource struct {
+	v4, v6 string
+}
+
+func (u *urlSource) fetch(ctx context.Context, cond sourceConditions) (v4, v6 fetchResult, err error) {
+	v4, err = fetchList(ctx, u.v4, cond.ipv4ETag, cond.ipv4Modified)
+	if err != nil {
+		return
+	}
+	v6, err = fetchList(ctx, u.v6, cond.ipv6ETag, cond.ipv6Modified)
+	return
+}
+
+func (u *urlSource) String() string {
+	return fmt.Sprintf("urls(%s, %s)", u.v4, u.v6)
+}
+
+func (u *urlSource) expand(repl *caddy.Replacer) {
+	u.v4 = repl.ReplaceAll(u.v4, "")
+	u.v6 = repl.ReplaceAll(u.v6, "")
+}
+
+// fileSource reads both the v4 and v6 prefixes from a single local file
+// (one CIDR per line), for air-gapped deployments that can't reach
+// cloudflare.com at all.
+type fileSource struct {
+	path string
+}
+
+func (f *fileSource) fetch(_ context.Context, _ sourceConditions) (v4, v6 fetchResult, err error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return fetchResult{}, fetchResult{}, err
+	}
+	defer file.Close()
+
+	prefixes, err := scanPrefixes(file)
+	if err != nil {
+		return fetchResult{}, fetchResult{}, err
+	}
+
+	var v4Prefixes, v6Prefixes []netip.Prefix
+	for _, p := range prefixes {
+		if p.Addr().Is4() {
+			v4Prefixes = append(v4Prefixes, p)
+		} else {
+			v6Prefixes = append(v6Prefixes, p)
+		}
+	}
+	return fetchResult{prefixes: v4Prefixes}, fetchResult{prefixes: v6Prefixes}, nil
+}
+
+func (f *fileSource) String() string {
+	return fmt.Sprintf("file(%s)", f.path)
+}
+
+func (f *fileSource) expand(repl *caddy.Replacer) {
+	f.path = repl.ReplaceAll(f.path, "")
+}
+
+// cloudflareIPsAPIURL is Cloudflare's authenticated IP-list endpoint, which
+// returns both families plus an etag in a single JSON response.
+const cloudflareIPsAPIURL = "https://api.cloudflare.com/client/v4/ips"
+
+// apiSource fetches the prefix lists from Cloudflare's authenticated
+// `GET /client/v4/ips` API, preferred in Cloudflare-for-Teams-style setups
+// over the public unauthenticated text endpoints.
+type apiSource struct {
+	token string
+}
+
+type cloudflareIPsResponse struct {
+	Success bool `json:"success"`
+	Errors  []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+	Result struct {
+		IPv4CIDRs []string `json:"ipv4_cidrs"`
+		IPv6CIDRs []string `json:"ipv6_cidrs"`
+		ETag      string   `json:"etag"`
+	} `json:"result"`
+}
+
+func (a *apiSource) fetch(ctx context.Context, cond sourceConditions) (v4, v6 fetchResult, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cloudflareIPsAPIURL, nil)
+	if err != nil {
+		return fetchResult{}, fetchResult{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fetchResult{}, fetchResult{}, err
+	}
+	defer resp.Body.Close()
+
+	var body cloudflareIPsResponse
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fetchResult{}, fetchResult{}, err
+	}
+	if !body.Success {
+		msg := "request failed"
+		if len(body.Errors) > 0 {
+			msg = body.Errors[0].Message
+		}
+		return fetchResult{}, fetchResult{}, fmt.Errorf("cloudflare ips api: %s", msg)
+	}
+
+	// The API reports a single etag covering both families; if it hasn't
+	// changed since our last fetch, there's nothing new to parse.
+	if body.Result.ETag != "" && body.Result.ETag == cond.ipv4ETag && body.Result.ETag == cond.ipv6ETag {
+		return fetchResult{notModified: true, etag: cond.ipv4ETag}, fetchResult{notModified: true, etag: cond.ipv6ETag}, nil
+	}
+
+	v4Prefixes, err := parsePrefixStrings(body.Result.IPv4CIDRs)
+	if err != nil {
+		return fetchResult{}, fetchResult{}, err
+	}
+	v6Prefixes, err := parsePrefixStrings(body.Result.IPv6CIDRs)
+	if err != nil {
+		return fetchResult{}, fetchResult{}, err
+	}
+
+	return fetchResult{prefixes: v4Prefixes, etag: body.Result.ETag},
+		fetchResult{prefixes: v6Prefixes, etag: body.Result.ETag},
+		nil
+}
+
+func (a *apiSource) String() string {
+	return "api"
+}
+
+func (a *apiSource) expand(repl *caddy.Replacer) {
+	a.token = repl.ReplaceAll(a.token, "")
+}
+
+func parsePrefixStrings(values []string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, v := range values {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, prefix)
+	}
+	return out, nil
+}
+
+// unmarshalSource parses the optional source sub-directive (urls/file/api)
+// nested inside a `cloudflare { ... }` block. d is positioned at the
+// directive name, same as the other cases in UnmarshalCaddyfile.
+func unmarshalSource(d *caddyfile.Dispenser) (Source, error) {
+	switch d.Val() {
+	case "urls":
+		args := d.RemainingArgs()
+		if len(args) != 2 {
+			return nil, d.ArgErr()
+		}
+		return &urlSource{v4: args[0], v6: args[1]}, nil
+	case "file":
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		return &fileSource{path: d.Val()}, nil
+	case "api":
+		src := &apiSource{}
+		for d.NextBlock(1) {
+			switch d.Val() {
+			case "token":
+				if !d.NextArg() {
+					return nil, d.ArgErr()
+				}
+				src.token = d.Val()
+			default:
+				return nil, d.ArgErr()
+			}
+		}
+		if src.token == "" {
+			return nil, d.Err("api source requires a token")
+		}
+		return src, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,106 @@
+package caddy_cloudflare_ip
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestUnmarshalSourceURLs(t *testing.T) {
+	input := `cloudflare {
+		urls https://example.com/v4 https://example.com/v6
+	}`
+
+	d := caddyfile.NewTestDispenser(input)
+	r := CloudflareIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	src, ok := r.source.(*urlSource)
+	if !ok {
+		t.Fatalf("expected *urlSource, got %T", r.source)
+	}
+	if src.v4 != "https://example.com/v4" || src.v6 != "https://example.com/v6" {
+		t.Errorf("unexpected urlSource: %+v", src)
+	}
+}
+
+func TestUnmarshalSourceAPI(t *testing.T) {
+	input := `cloudflare {
+		api {
+			token s3cr3t
+		}
+	}`
+
+	d := caddyfile.NewTestDispenser(input)
+	r := CloudflareIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	src, ok := r.source.(*apiSource)
+	if !ok {
+		t.Fatalf("expected *apiSource, got %T", r.source)
+	}
+	if src.token != "s3cr3t" {
+		t.Errorf("unexpected token: %q", src.token)
+	}
+}
+
+func TestProvisionExpandsSourcePlaceholder(t *testing.T) {
+	os.Setenv("CF_TEST_TOKEN", "s3cr3t")
+	defer os.Unsetenv("CF_TEST_TOKEN")
+
+	input := `cloudflare {
+		api {
+			token {env.CF_TEST_TOKEN}
+		}
+	}`
+
+	d := caddyfile.NewTestDispenser(input)
+	r := CloudflareIPRange{}
+	if err := r.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	if err := r.Provision(ctx); err != nil {
+		t.Fatalf("error provisioning: %v", err)
+	}
+
+	src, ok := r.source.(*apiSource)
+	if !ok {
+		t.Fatalf("expected *apiSource, got %T", r.source)
+	}
+	if src.token != "s3cr3t" {
+		t.Errorf("expected expanded token %q, got %q", "s3cr3t", src.token)
+	}
+}
+
+func TestFileSourceFetch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ranges.txt")
+	contents := "173.245.48.0/20\n2400:cb00::/32\n"
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("write test file: %v", err)
+	}
+
+	src := &fileSource{path: path}
+	v4, v6, err := src.fetch(nil, sourceConditions{})
+	if err != nil {
+		t.Fatalf("fetch error: %v", err)
+	}
+	if len(v4.prefixes) != 1 {
+		t.Errorf("expected 1 v4 prefix, got %d", len(v4.prefixes))
+	}
+	if len(v6.prefixes) != 1 {
+		t.Errorf("expected 1 v6 prefix, got %d", len(v6.prefixes))
+	}
+}